@@ -0,0 +1,137 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/Godeps/_workspace/src/github.com/mailgun/log"
+)
+
+// captureRotationPolicy configures when a session's rolling capture log
+// rotates to a new file: once the current file has received maxBytes,
+// or once maxDuration has elapsed since it was opened, whichever comes
+// first.
+type captureRotationPolicy struct {
+	maxBytes    int64
+	maxDuration time.Duration
+}
+
+// defaultCaptureRotationPolicy is used when the registry's capturePolicy
+// is left at its zero value.
+var defaultCaptureRotationPolicy = captureRotationPolicy{
+	maxBytes:    10 * 1024 * 1024,
+	maxDuration: time.Hour,
+}
+
+const captureExt = ".capture.log"
+
+// rollingCapture is a file-backed, size-and-time-bounded replacement for
+// the unbounded in-memory bytes.Buffer session.start used to capture a
+// shell's combined output: everything written is durably persisted to
+// disk across files rotated per policy, while a capped in-memory tail is
+// kept readable so callers that still expect to read back recent output
+// (e.g. the audit event built when the shell exits) keep working.
+type rollingCapture struct {
+	mu       sync.Mutex
+	dir      string
+	sid      string
+	policy   captureRotationPolicy
+	f        *os.File
+	opened   time.Time
+	written  int64
+	rotation int
+	tail     bytes.Buffer
+}
+
+// newRollingCapture opens the first rotation of sid's capture log under
+// dir.
+func newRollingCapture(dir, sid string, policy captureRotationPolicy) (*rollingCapture, error) {
+	c := &rollingCapture{dir: dir, sid: sid, policy: policy}
+	if err := c.rotate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *rollingCapture) rotate() error {
+	if c.f != nil {
+		if err := c.f.Close(); err != nil {
+			log.Errorf("failed to close capture log for %v: %v", c.sid, err)
+		}
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create capture dir %v: %v", c.dir, err)
+	}
+	c.rotation++
+	name := filepath.Join(c.dir, fmt.Sprintf("%v.%d%v", c.sid, c.rotation, captureExt))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open capture log %v: %v", name, err)
+	}
+	c.f = f
+	c.opened = time.Now()
+	c.written = 0
+	return nil
+}
+
+// Write persists p to the current rotation, rotating first if it has
+// outgrown policy.maxBytes or policy.maxDuration, and mirrors it into
+// the bounded in-memory tail.
+func (c *rollingCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.written >= c.policy.maxBytes || time.Since(c.opened) >= c.policy.maxDuration {
+		if err := c.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.f.Write(p)
+	c.written += int64(n)
+
+	c.tail.Write(p)
+	if excess := c.tail.Len() - int(c.policy.maxBytes); excess > 0 {
+		c.tail.Next(excess)
+	}
+	return n, err
+}
+
+// Read drains the in-memory tail, giving callers such as the audit
+// event a bounded view of recently captured output without holding the
+// entire session's output in memory.
+func (c *rollingCapture) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tail.Read(p)
+}
+
+func (c *rollingCapture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	return c.f.Close()
+}
+
+// newCapture creates the session's rolling capture log, rotated per the
+// registry's configured capturePolicy (or defaultCaptureRotationPolicy
+// if the server left it unset), alongside the existing recordings.
+func (r *sessionRegistry) newCapture(sid string) (*rollingCapture, error) {
+	dir := r.recordingsDir
+	if dir == "" {
+		dir = defaultRecordingsDir
+	}
+	policy := r.capturePolicy
+	if policy.maxBytes == 0 {
+		policy.maxBytes = defaultCaptureRotationPolicy.maxBytes
+	}
+	if policy.maxDuration == 0 {
+		policy.maxDuration = defaultCaptureRotationPolicy.maxDuration
+	}
+	return newRollingCapture(dir, sid, policy)
+}
@@ -0,0 +1,175 @@
+package srv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// LoginBackend prepares the command that will run as a session's shell
+// for the connection's authenticated principal: it sets the process
+// credentials, environment, and working directory cmd should start
+// with, or returns an error if the login must be refused.
+type LoginBackend interface {
+	// Prepare configures cmd in place to run as the backend's target
+	// user.
+	Prepare(cmd *exec.Cmd) error
+}
+
+// loginBackendFor selects the LoginBackend session.start should use for
+// principal: the current-process user runs directly, with a login
+// environment built from its passwd entry, any other known system user
+// is impersonated the way `su
+// -l <user>` would, and anyone else — including a system/service account
+// whose passwd entry sets a nologin shell — falls back to nologin.
+func loginBackendFor(principal string) LoginBackend {
+	if self, err := user.Current(); err == nil && self.Username == principal {
+		return selfLoginBackend{}
+	}
+	if _, err := user.Lookup(principal); err != nil {
+		return nologinBackend{}
+	}
+	if shell, err := loginShell(principal); err == nil && isNologinShell(shell) {
+		return nologinBackend{}
+	}
+	return newSuLoginBackend(principal)
+}
+
+// nologinShells are the standard "no interactive login" shells useradd
+// and adduser set for system and service accounts.
+var nologinShells = []string{"/sbin/nologin", "/usr/sbin/nologin", "/bin/false", "/usr/bin/false"}
+
+func isNologinShell(shell string) bool {
+	for _, s := range nologinShells {
+		if shell == s {
+			return true
+		}
+	}
+	return false
+}
+
+// selfLoginBackend runs the shell as the current process user, with a
+// minimal login environment, starting in that user's home directory. It
+// keeps the registry's historical choice of process user for principals
+// that authenticate as whatever user the teleport process itself is
+// running under.
+type selfLoginBackend struct{}
+
+func (selfLoginBackend) Prepare(cmd *exec.Cmd) error {
+	u, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("failed to look up current user: %v", err)
+	}
+	shell, err := loginShell(u.Username)
+	if err != nil {
+		shell = "/bin/sh"
+	}
+	cmd.Dir = u.HomeDir
+	cmd.Env = []string{
+		fmt.Sprintf("HOME=%v", u.HomeDir),
+		fmt.Sprintf("SHELL=%v", shell),
+		fmt.Sprintf("USER=%v", u.Username),
+		fmt.Sprintf("LOGNAME=%v", u.Username),
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"TERM=xterm",
+	}
+	return nil
+}
+
+// nologinBackend refuses to start a shell at all. It gives principals
+// with no matching system account an explicit, named "no access"
+// outcome instead of silently falling through to selfLoginBackend.
+type nologinBackend struct{}
+
+func (nologinBackend) Prepare(cmd *exec.Cmd) error {
+	return fmt.Errorf("interactive login is disabled for this principal")
+}
+
+// suLoginBackend impersonates a target system user the way `su -l
+// <user>` would: it runs the command with that user's uid/gid and
+// supplementary groups, populates the standard login environment
+// variables from their passwd entry, and starts the command in their
+// home directory.
+type suLoginBackend struct {
+	username string
+}
+
+func newSuLoginBackend(username string) *suLoginBackend {
+	return &suLoginBackend{username: username}
+}
+
+func (b *suLoginBackend) Prepare(cmd *exec.Cmd) error {
+	u, err := user.Lookup(b.username)
+	if err != nil {
+		return fmt.Errorf("failed to look up user %v: %v", b.username, err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid uid for user %v: %v", b.username, err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid gid for user %v: %v", b.username, err)
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return fmt.Errorf("failed to look up groups for user %v: %v", b.username, err)
+	}
+	groups := make([]uint32, 0, len(groupIDs))
+	for _, g := range groupIDs {
+		id, err := strconv.ParseUint(g, 10, 32)
+		if err != nil {
+			continue
+		}
+		groups = append(groups, uint32(id))
+	}
+
+	shell, err := loginShell(b.username)
+	if err != nil {
+		shell = "/bin/sh"
+	} else if isNologinShell(shell) {
+		// Defense in depth: loginBackendFor already routes a nologin
+		// principal to nologinBackend, but refuse here too in case this
+		// backend is ever constructed directly.
+		return fmt.Errorf("interactive login is disabled for user %v", b.username)
+	}
+
+	cmd.Dir = u.HomeDir
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid:    uint32(uid),
+			Gid:    uint32(gid),
+			Groups: groups,
+		},
+	}
+	cmd.Env = []string{
+		fmt.Sprintf("HOME=%v", u.HomeDir),
+		fmt.Sprintf("SHELL=%v", shell),
+		fmt.Sprintf("USER=%v", u.Username),
+		fmt.Sprintf("LOGNAME=%v", u.Username),
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"TERM=xterm",
+	}
+	return nil
+}
+
+// loginShell looks up username's login shell from /etc/passwd, since
+// the standard library's os/user does not expose it.
+func loginShell(username string) (string, error) {
+	data, err := ioutil.ReadFile("/etc/passwd")
+	if err != nil {
+		return "", fmt.Errorf("failed to read /etc/passwd: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 || fields[0] != username {
+			continue
+		}
+		return fields[6], nil
+	}
+	return "", fmt.Errorf("user %v not found in /etc/passwd", username)
+}
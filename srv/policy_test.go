@@ -0,0 +1,94 @@
+package srv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyCheckerTransitions(t *testing.T) {
+	policies := []sessionPolicy{
+		{Owner: "alice", Principals: []string{"bob"}, Mode: ModePeer},
+		{Owner: "alice", Principals: []string{"carol"}, Mode: ModeObserver},
+		{Owner: "alice", Principals: []string{"mallory"}, Mode: ModeModerator, RequireApproval: true},
+	}
+	checker := newPolicyChecker(policies)
+	sess := &session{owner: "alice"}
+
+	cases := []struct {
+		principal    string
+		wantErr      bool
+		wantMode     PartyMode
+		wantApproval bool
+	}{
+		{principal: "bob", wantMode: ModePeer},
+		{principal: "carol", wantMode: ModeObserver},
+		{principal: "mallory", wantMode: ModeModerator, wantApproval: true},
+		{principal: "eve", wantErr: true},
+	}
+
+	for _, c := range cases {
+		decision, err := checker.CheckAccess(sess, c.principal)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("CheckAccess(%v): expected denial, got %v", c.principal, decision)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("CheckAccess(%v): unexpected error: %v", c.principal, err)
+		}
+		if decision.Mode != c.wantMode {
+			t.Errorf("CheckAccess(%v): got mode %v, want %v", c.principal, decision.Mode, c.wantMode)
+		}
+		if decision.RequireApproval != c.wantApproval {
+			t.Errorf("CheckAccess(%v): got RequireApproval %v, want %v", c.principal, decision.RequireApproval, c.wantApproval)
+		}
+	}
+}
+
+func TestPolicyCheckerWildcards(t *testing.T) {
+	checker := newPolicyChecker([]sessionPolicy{
+		{Owner: "*", Principals: []string{"*"}, Mode: ModeObserver},
+	})
+	sess := &session{owner: "anyone"}
+
+	decision, err := checker.CheckAccess(sess, "whoever")
+	if err != nil {
+		t.Fatalf("CheckAccess: unexpected error: %v", err)
+	}
+	if decision.Mode != ModeObserver {
+		t.Errorf("CheckAccess: got mode %v, want %v", decision.Mode, ModeObserver)
+	}
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policy.json")
+	data := `[{"owner":"alice","principals":["bob"],"mode":"peer"}]`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	reg := newSessionRegistry(nil)
+	if err := reg.LoadAccessPolicy(path); err != nil {
+		t.Fatalf("LoadAccessPolicy: %v", err)
+	}
+	if reg.checker == nil {
+		t.Fatal("LoadAccessPolicy did not install a checker")
+	}
+
+	decision, err := reg.checker.CheckAccess(&session{owner: "alice"}, "bob")
+	if err != nil {
+		t.Fatalf("CheckAccess: unexpected error: %v", err)
+	}
+	if decision.Mode != ModePeer {
+		t.Errorf("CheckAccess: got mode %v, want %v", decision.Mode, ModePeer)
+	}
+}
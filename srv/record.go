@@ -0,0 +1,249 @@
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType identifies the kind of event recorded in a session's event
+// stream.
+type EventType string
+
+const (
+	EventSessionStart EventType = "session.start"
+	EventResize       EventType = "session.resize"
+	EventOutput       EventType = "session.output"
+	EventExit         EventType = "session.exit"
+	EventPartyJoin    EventType = "party.join"
+	EventPartyLeave   EventType = "party.leave"
+	EventPause        EventType = "session.pause"
+	EventResume       EventType = "session.resume"
+)
+
+// SessionEvent is a single, timestamped entry in a session's recorded
+// event stream. Offset is measured in milliseconds from the session's
+// start event, so recordings replay correctly regardless of wall clock
+// skew between the recorder and the player.
+type SessionEvent struct {
+	Type   EventType `json:"type"`
+	Offset int64     `json:"offset_ms"`
+	Width  int       `json:"width,omitempty"`
+	Height int       `json:"height,omitempty"`
+	Data   []byte    `json:"data,omitempty"`
+	Party  string    `json:"party,omitempty"`
+	Code   int       `json:"code,omitempty"`
+	// StartedAt is the absolute wall-clock time the session started, Unix
+	// seconds, set only on EventSessionStart. It lets a recording exported
+	// long after the fact report when the session actually ran instead of
+	// when it was exported.
+	StartedAt int64 `json:"started_at,omitempty"`
+}
+
+// SessionRecorder persists the structured event stream produced by a
+// session while it runs. Implementations must be safe for concurrent
+// use: events are emitted from the "record" writer's drain goroutine
+// (PTY output), resize requests and party join/leave, all of which can
+// happen at once.
+type SessionRecorder interface {
+	// Record appends e to the session's event stream.
+	Record(e SessionEvent) error
+	// Close flushes and releases any resources held by the recorder.
+	Close() error
+}
+
+const recordingExt = ".events.json"
+
+// defaultRecordingsDir is used when the server has not been configured
+// with an explicit recordings directory.
+const defaultRecordingsDir = "/var/lib/teleport/recordings"
+
+// fileRecorder is the default SessionRecorder. It appends each event as a
+// single line of newline-delimited JSON to a per-session file on disk, so
+// recordings survive process restarts and can be tailed like any other
+// log.
+type fileRecorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func newFileRecorder(dir, sid string) (*fileRecorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create recordings dir %v: %v", dir, err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, sid+recordingExt),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording for %v: %v", sid, err)
+	}
+	return &fileRecorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (r *fileRecorder) Record(e SessionEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(e)
+}
+
+func (r *fileRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// recorderWriter adapts a SessionRecorder to io.Writer so that raw PTY
+// output can be tapped off the existing multiWriter fan-out, alongside
+// the capture buffer used for audit events.
+type recorderWriter struct {
+	rec   SessionRecorder
+	start time.Time
+}
+
+func (w *recorderWriter) Write(p []byte) (int, error) {
+	data := make([]byte, len(p))
+	copy(data, p)
+	if err := w.rec.Record(SessionEvent{
+		Type:   EventOutput,
+		Offset: time.Since(w.start).Nanoseconds() / int64(time.Millisecond),
+		Data:   data,
+	}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// newRecorder creates the default, disk-backed SessionRecorder for sid.
+func (r *sessionRegistry) newRecorder(sid string) (SessionRecorder, error) {
+	dir := r.recordingsDir
+	if dir == "" {
+		dir = defaultRecordingsDir
+	}
+	return newFileRecorder(dir, sid)
+}
+
+// ListRecordings returns the session IDs of every recording available on
+// disk.
+func (r *sessionRegistry) ListRecordings() ([]string, error) {
+	dir := r.recordingsDir
+	if dir == "" {
+		dir = defaultRecordingsDir
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list recordings: %v", err)
+	}
+	out := make([]string, 0, len(infos))
+	for _, fi := range infos {
+		name := fi.Name()
+		if strings.HasSuffix(name, recordingExt) {
+			out = append(out, strings.TrimSuffix(name, recordingExt))
+		}
+	}
+	return out, nil
+}
+
+// GetRecording opens the raw, newline-delimited JSON event stream
+// recorded for sid. The caller is responsible for closing it.
+func (r *sessionRegistry) GetRecording(sid string) (io.ReadCloser, error) {
+	dir := r.recordingsDir
+	if dir == "" {
+		dir = defaultRecordingsDir
+	}
+	f, err := os.Open(filepath.Join(dir, sid+recordingExt))
+	if err != nil {
+		return nil, fmt.Errorf("recording for %v not found: %v", sid, err)
+	}
+	return f, nil
+}
+
+// asciicastHeader is the v2 asciicast header, see
+// https://github.com/asciinema/asciinema/blob/master/doc/asciicast-v2.md
+type asciicastHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Command   string `json:"command,omitempty"`
+}
+
+// ExportAsciicast reads the recorded event stream for sid and writes it to
+// w in asciinema v2 (asciicast) format, so it can be replayed with
+// `asciinema play`.
+func (r *sessionRegistry) ExportAsciicast(sid string, w io.Writer) error {
+	rc, err := r.GetRecording(sid)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	header := asciicastHeader{Version: 2, Width: 80, Height: 24}
+	dec := json.NewDecoder(rc)
+	enc := json.NewEncoder(w)
+
+	headerWritten := false
+	writeHeader := func() error {
+		if headerWritten {
+			return nil
+		}
+		headerWritten = true
+		return enc.Encode(header)
+	}
+	for dec.More() {
+		var e SessionEvent
+		if err := dec.Decode(&e); err != nil {
+			return fmt.Errorf("failed to decode recording for %v: %v", sid, err)
+		}
+		switch e.Type {
+		case EventSessionStart:
+			if e.Width != 0 {
+				header.Width = e.Width
+			}
+			if e.Height != 0 {
+				header.Height = e.Height
+			}
+			if e.StartedAt != 0 {
+				header.Timestamp = e.StartedAt
+			} else {
+				// Older recordings predate StartedAt: fall back to the
+				// export-time clock, which is wrong by however long the
+				// recording sat on disk before being exported.
+				header.Timestamp = time.Now().Add(-time.Duration(e.Offset) * time.Millisecond).Unix()
+			}
+			// Deliberately not written yet: a resize that arrives before
+			// any output below still needs to fold into these dimensions
+			// rather than lock the header to whatever EventSessionStart
+			// itself happened to carry.
+		case EventResize:
+			if !headerWritten {
+				header.Width = e.Width
+				header.Height = e.Height
+				continue
+			}
+			if err := enc.Encode([]interface{}{
+				float64(e.Offset) / 1000.0, "r", fmt.Sprintf("%vx%v", e.Width, e.Height),
+			}); err != nil {
+				return err
+			}
+		case EventOutput:
+			if err := writeHeader(); err != nil {
+				return err
+			}
+			if err := enc.Encode([]interface{}{
+				float64(e.Offset) / 1000.0, "o", string(e.Data),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return writeHeader()
+}
@@ -1,14 +1,15 @@
 package srv
 
 import (
+	"bufio"
 	"bytes"
 
 	"fmt"
 	"io"
-	"os"
 	"os/exec"
 	"strings"
 	"sync"
+	"time"
 
 	"code.google.com/p/go-uuid/uuid"
 	"github.com/gravitational/teleport/Godeps/_workspace/src/github.com/codahale/lunk"
@@ -21,6 +22,17 @@ type sessionRegistry struct {
 	sync.Mutex
 	sessions map[string]*session
 	srv      *Server
+	// recordingsDir overrides defaultRecordingsDir when set, letting the
+	// server configure where session recordings are persisted.
+	recordingsDir string
+	// checker decides who may join an existing session, and in what
+	// mode. A nil checker allows any party to join as a peer, matching
+	// the registry's historical behavior.
+	checker SessionAccessChecker
+	// capturePolicy overrides defaultCaptureRotationPolicy when set,
+	// letting the server configure how often a session's rolling
+	// capture log rotates.
+	capturePolicy captureRotationPolicy
 }
 
 func (s *sessionRegistry) newShell(sid string, sconn *ssh.ServerConn, ch ssh.Channel, req *ssh.Request, ctx *ctx) error {
@@ -45,8 +57,221 @@ func (s *sessionRegistry) joinShell(sid string, sconn *ssh.ServerConn, ch ssh.Ch
 		log.Infof("%v creating new session: %v", ctx, sid)
 		return s.newShell(sid, sconn, ch, req, ctx)
 	}
-	log.Infof("%v joining session: %v", ctx, sess.id)
-	sess.join(sconn, ch, req, ctx)
+
+	decision := AccessDecision{Mode: ModePeer}
+	if s.checker != nil {
+		var err error
+		if decision, err = s.checker.CheckAccess(sess, ctx.login); err != nil {
+			log.Errorf("%v denied joining session %v: %v", ctx, sess.id, err)
+			return err
+		}
+	}
+
+	if decision.RequireApproval {
+		log.Infof("%v waiting for moderator approval to join session: %v", ctx, sess.id)
+		sess.requestJoin(newParty(sess, sconn, ch, ctx, decision.Mode))
+		return nil
+	}
+	log.Infof("%v joining session: %v as %v", ctx, sess.id, decision.Mode)
+	sess.join(sconn, ch, req, ctx, decision.Mode)
+	return nil
+}
+
+// kickParty forcibly removes pid from sid, closing its channel. The lock
+// is held for the whole operation: sess.kick and the subsequent removal
+// both touch session.parties, which has no locking of its own.
+func (s *sessionRegistry) kickParty(sid, pid string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	sess, found := s.findSession(sid)
+	if !found {
+		return fmt.Errorf("session %v not found", sid)
+	}
+	if err := sess.kick(pid); err != nil {
+		return err
+	}
+	return s.removeParty(sess, pid)
+}
+
+// pauseSession buffers PTY output and stops forwarding stdin (paused) or
+// releases it back to normal streaming (resumed).
+func (s *sessionRegistry) pauseSession(sid string, paused bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	sess, found := s.findSession(sid)
+	if !found {
+		return fmt.Errorf("session %v not found", sid)
+	}
+	if paused {
+		sess.pause()
+	} else {
+		sess.resume()
+	}
+	return nil
+}
+
+// approveParty completes a join that was held for moderator approval.
+func (s *sessionRegistry) approveParty(sid, pid string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	sess, found := s.findSession(sid)
+	if !found {
+		return fmt.Errorf("session %v not found", sid)
+	}
+	return sess.approve(pid)
+}
+
+// denyParty rejects a join that was held for moderator approval.
+func (s *sessionRegistry) denyParty(sid, pid string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	sess, found := s.findSession(sid)
+	if !found {
+		return fmt.Errorf("session %v not found", sid)
+	}
+	return sess.deny(pid)
+}
+
+// terminateSession forcibly ends sid, disconnecting every attached party.
+func (s *sessionRegistry) terminateSession(sid string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	sess, found := s.findSession(sid)
+	if !found {
+		return fmt.Errorf("session %v not found", sid)
+	}
+	if err := sess.terminate(); err != nil {
+		return err
+	}
+	delete(s.sessions, sid)
+	return nil
+}
+
+// requireModerator returns an error unless principal is currently
+// permitted to join sid in ModeModerator, gating access to the session
+// control subsystem.
+func (s *sessionRegistry) requireModerator(sid, principal string) error {
+	s.Lock()
+	sess, found := s.findSession(sid)
+	checker := s.checker
+	s.Unlock()
+	if !found {
+		return fmt.Errorf("session %v not found", sid)
+	}
+	if checker == nil {
+		return fmt.Errorf("session %v has no access policy configured", sid)
+	}
+	decision, err := checker.CheckAccess(sess, principal)
+	if err != nil {
+		return err
+	}
+	if decision.Mode != ModeModerator {
+		return fmt.Errorf("%v is not a moderator of session %v", principal, sid)
+	}
+	return nil
+}
+
+// dispatchControl parses and runs a single line read from the session
+// control subsystem's channel.
+func (s *sessionRegistry) dispatchControl(sid, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	switch fields[0] {
+	case "kick":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: kick <party>")
+		}
+		return s.kickParty(sid, fields[1])
+	case "pause":
+		return s.pauseSession(sid, true)
+	case "resume":
+		return s.pauseSession(sid, false)
+	case "approve":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: approve <party>")
+		}
+		return s.approveParty(sid, fields[1])
+	case "deny":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: deny <party>")
+		}
+		return s.denyParty(sid, fields[1])
+	case "terminate":
+		return s.terminateSession(sid)
+	default:
+		return fmt.Errorf("unknown moderate command: %v", fields[0])
+	}
+}
+
+// winChangeRequest is the decoded payload of an SSH "window-change"
+// channel request (RFC 4254 6.7): the terminal dimensions the client
+// resized to.
+type winChangeRequest struct {
+	Width       uint32
+	Height      uint32
+	PixelWidth  uint32
+	PixelHeight uint32
+}
+
+// handleWinChange decodes a "window-change" request for sid and resizes
+// its PTY accordingly.
+func (s *sessionRegistry) handleWinChange(sid string, req *ssh.Request) error {
+	var r winChangeRequest
+	if err := ssh.Unmarshal(req.Payload, &r); err != nil {
+		return fmt.Errorf("failed to parse window-change request: %v", err)
+	}
+	s.Lock()
+	sess, found := s.findSession(sid)
+	s.Unlock()
+	if !found {
+		return fmt.Errorf("session %v not found", sid)
+	}
+	return sess.resize(int(r.Width), int(r.Height))
+}
+
+// WatchChannelRequests consumes reqs, the per-channel request stream
+// ssh.NewChannel.Accept returns alongside a channel, for as long as sid's
+// party stays attached, dispatching every "window-change" request to
+// handleWinChange and replying false to any other request that asks for
+// a reply. The
+// per-channel SSH request dispatcher should call this once, right after
+// newShell/joinShell returns, passing the same reqs channel it already
+// holds for that party's channel; that dispatcher lives outside this
+// package and isn't part of this snapshot, so this is the one missing
+// wire-up.
+func (s *sessionRegistry) WatchChannelRequests(sid string, reqs <-chan *ssh.Request) {
+	go func() {
+		for req := range reqs {
+			var err error
+			if req.Type == "window-change" {
+				err = s.handleWinChange(sid, req)
+				if err != nil {
+					log.Errorf("failed to handle window-change for %v: %v", sid, err)
+				}
+			}
+			if req.WantReply {
+				req.Reply(err == nil && req.Type == "window-change", nil)
+			}
+		}
+	}()
+}
+
+// removePending discards pid from sess.pending if it is still awaiting
+// moderator review; it is a no-op if pid has already been approved or
+// denied. Used as a closer so a connection that drops while waiting for
+// approval doesn't leave a stale entry (and a dead channel behind it) in
+// session.pending.
+func (s *sessionRegistry) removePending(sess *session, pid string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(sess.pending, pid)
 	return nil
 }
 
@@ -58,6 +283,13 @@ func (s *sessionRegistry) leaveShell(sid, pid string) error {
 	if !found {
 		return fmt.Errorf("session %v not found", sid)
 	}
+	return s.removeParty(sess, pid)
+}
+
+// removeParty detaches pid from sess and, if it was the last party,
+// tears the session down and removes it from the registry. Callers must
+// hold s.Lock() for the duration of the call.
+func (s *sessionRegistry) removeParty(sess *session, pid string) error {
 	if err := sess.leave(pid); err != nil {
 		log.Errorf("failed to leave session: %v", err)
 		return err
@@ -94,11 +326,27 @@ func (s *sessionRegistry) findSession(id string) (*session, bool) {
 	return sess, true
 }
 
+// newSessionRegistry builds the registry for srv, picking up the
+// recordings directory and capture rotation policy from its config (and
+// loading the configured session access policy file, if any) so both are
+// actually in effect for the server's sessions rather than only
+// exercised from tests.
 func newSessionRegistry(srv *Server) *sessionRegistry {
-	return &sessionRegistry{
+	reg := &sessionRegistry{
 		srv:      srv,
 		sessions: make(map[string]*session),
 	}
+	if srv == nil {
+		return reg
+	}
+	reg.recordingsDir = srv.recordingsDir
+	reg.capturePolicy = srv.capturePolicy
+	if srv.accessPolicyFile != "" {
+		if err := reg.LoadAccessPolicy(srv.accessPolicyFile); err != nil {
+			log.Errorf("failed to load session access policy %v: %v", srv.accessPolicyFile, err)
+		}
+	}
+	return reg
 }
 
 type session struct {
@@ -108,27 +356,87 @@ type session struct {
 	writer  *multiWriter
 	parties map[string]*party
 	t       *term
+	rec     SessionRecorder
+	// capture is the session's rolling, file-backed output log, set when
+	// it was opened successfully; nil when start fell back to an
+	// in-memory buffer.
+	capture   *rollingCapture
+	startedAt time.Time
+	// owner is the principal that created the session, used by
+	// SessionAccessChecker to evaluate join requests from other parties.
+	owner string
+	// pending holds parties whose join is held for moderator approval,
+	// keyed by party id, until approve or deny is called.
+	pending map[string]*party
+	// inputGate blocks every party's stdin from reaching the PTY while
+	// the session is paused.
+	inputGate *gate
 }
 
 func newSession(id string, r *sessionRegistry) *session {
 	return &session{
-		id:      id,
-		r:       r,
-		parties: make(map[string]*party),
-		writer:  newMultiWriter(),
+		id:        id,
+		r:         r,
+		parties:   make(map[string]*party),
+		pending:   make(map[string]*party),
+		writer:    newMultiWriter(),
+		inputGate: newGate(),
+		startedAt: time.Now(),
 	}
 }
 
 func (s *session) Close() error {
+	// The "capture" and "record" writer entries are never removed via
+	// leave (unlike per-party ids), so without this their drain
+	// goroutines would block on cond.Wait() forever.
+	s.writer.deleteWriter("capture")
+	s.writer.deleteWriter("record")
+	if s.rec != nil {
+		if err := s.rec.Close(); err != nil {
+			log.Errorf("%v failed to close recorder: %v", s, err)
+		}
+	}
+	if s.capture != nil {
+		if err := s.capture.Close(); err != nil {
+			log.Errorf("%v failed to close capture log: %v", s, err)
+		}
+	}
 	if s.t != nil {
 		return s.t.Close()
 	}
 	return nil
 }
 
+// emit records e into the session's event stream, timestamping it with
+// the number of milliseconds elapsed since the session started.
+func (s *session) emit(e SessionEvent) {
+	if s.rec == nil {
+		return
+	}
+	e.Offset = time.Since(s.startedAt).Nanoseconds() / int64(time.Millisecond)
+	if err := s.rec.Record(e); err != nil {
+		log.Errorf("%v failed to record event %v: %v", s, e.Type, err)
+	}
+}
+
+// resize updates the session's PTY size and records the change, so it is
+// reflected when the recording is replayed. It is invoked from the
+// window-change SSH request handler for every party attached to the
+// session.
+func (s *session) resize(w, h int) error {
+	if s.t != nil {
+		if err := s.t.setWinsize(w, h); err != nil {
+			return err
+		}
+	}
+	s.emit(SessionEvent{Type: EventResize, Width: w, Height: h})
+	return nil
+}
+
 func (s *session) start(sconn *ssh.ServerConn, ch ssh.Channel, ctx *ctx) error {
 	s.eid = ctx.eid
-	p := newParty(s, sconn, ch, ctx)
+	s.owner = ctx.login
+	p := newParty(s, sconn, ch, ctx, ModePeer)
 	if p.ctx.getTerm() != nil {
 		s.t = p.ctx.getTerm()
 		p.ctx.setTerm(nil)
@@ -140,27 +448,49 @@ func (s *session) start(sconn *ssh.ServerConn, ch ssh.Channel, ctx *ctx) error {
 		}
 	}
 	cmd := exec.Command(s.r.srv.shell)
-	// TODO(klizhentas) figure out linux user policy for launching shells,
-	// what user and environment should we use to execute the shell? the simplest
-	// answer is to use current user and env, however  what if we are root?
-	cmd.Env = []string{"TERM=xterm", fmt.Sprintf("HOME=%v", os.Getenv("HOME"))}
+	if err := loginBackendFor(ctx.login).Prepare(cmd); err != nil {
+		log.Errorf("%v login backend rejected shell: %v", p.ctx, err)
+		return err
+	}
 	if err := s.t.run(cmd); err != nil {
 		log.Infof("%v failed to start shell: %v", p.ctx, err)
 		return err
 	}
 	log.Infof("%v starting shell input/output streaming", p.ctx)
 
-	// Pipe session to shell and visa-versa capturing input and output
-	out := &bytes.Buffer{}
+	if rec, err := s.r.newRecorder(s.id); err != nil {
+		// Recording is best-effort: a party should still be able to use the
+		// shell even if we failed to open a recorder (e.g. disk full).
+		log.Errorf("%v failed to start recorder: %v", p.ctx, err)
+	} else {
+		s.rec = rec
+	}
+	s.emit(SessionEvent{Type: EventSessionStart, StartedAt: s.startedAt.Unix()})
 
-	// TODO(klizhentas) implement capturing as a thread safe factored out feature
-	// what is important is that writes and reads to buffer should be protected
-	// out contains captured command output
+	// Pipe session to shell and visa-versa, capturing input and output
+	// to a rolling, file-backed log so a long-lived session's capture
+	// doesn't grow an unbounded in-memory buffer.
+	var out io.ReadWriter
+	if capture, err := s.r.newCapture(s.id); err != nil {
+		// Capturing is best-effort: a party should still be able to use
+		// the shell even if we failed to open the capture log (e.g.
+		// disk full).
+		log.Errorf("%v failed to open capture log, falling back to in-memory buffer: %v", p.ctx, err)
+		out = &safeBuffer{}
+	} else {
+		s.capture = capture
+		out = capture
+	}
 	s.writer.addWriter("capture", out)
+	if s.rec != nil {
+		s.writer.addWriter("record", &recorderWriter{rec: s.rec, start: s.startedAt})
+	}
 
 	s.addParty(p)
 
+	ptyCopyDone := make(chan struct{})
 	go func() {
+		defer close(ptyCopyDone)
 		written, err := io.Copy(s.writer, s.t.pty)
 		log.Infof("%v shell to channel copy closed, bytes written: %v, err: %v",
 			p.ctx, written, err)
@@ -168,13 +498,36 @@ func (s *session) start(sconn *ssh.ServerConn, ch ssh.Channel, ctx *ctx) error {
 
 	go func() {
 		result, err := collectStatus(cmd, cmd.Wait())
+		// cmd.Wait returning only means the shell process exited; the PTY
+		// copy above is a separate goroutine and may still be reading the
+		// last of its output. Wait for it to finish producing chunks, then
+		// for multiWriter's async drain goroutine to actually deliver them,
+		// before snapshotting — otherwise trailing output can be missing
+		// below.
+		<-ptyCopyDone
+		flushed := make(chan struct{})
+		go func() {
+			s.writer.flush("capture")
+			close(flushed)
+		}()
+		select {
+		case <-flushed:
+		case <-time.After(captureFlushTimeout):
+			log.Errorf("%v timed out waiting for capture log to flush, snapshot may miss trailing output", p.ctx)
+		}
+		// Snapshot once and reuse it for whichever audit event(s) fire
+		// below: auditSnapshot drains out, so a second call after the
+		// first would see nothing left to report.
+		snapshot := auditSnapshot(p.ctx, out)
 		if err != nil {
 			log.Errorf("%v wait failed: %v", p.ctx, err)
-			s.r.srv.emit(ctx.eid, events.NewShell(sconn, s.r.srv.shell, out, -1, err))
+			s.r.srv.emit(ctx.eid, events.NewShell(sconn, s.r.srv.shell, snapshot, -1, err))
+			s.emit(SessionEvent{Type: EventExit, Code: -1})
 		}
 		if result != nil {
 			log.Infof("%v result collected: %v", p.ctx, result)
-			s.r.srv.emit(ctx.eid, events.NewShell(sconn, s.r.srv.shell, out, result.code, nil))
+			s.r.srv.emit(ctx.eid, events.NewShell(sconn, s.r.srv.shell, snapshot, result.code, nil))
+			s.emit(SessionEvent{Type: EventExit, Code: result.code})
 			s.r.broadcastResult(s.id, *result)
 			log.Infof("%v result broadcasted", p.ctx)
 		}
@@ -183,6 +536,42 @@ func (s *session) start(sconn *ssh.ServerConn, ch ssh.Channel, ctx *ctx) error {
 	return nil
 }
 
+// safeBuffer is a mutex-protected bytes.Buffer, used as session.start's
+// capture fallback when the rolling capture log couldn't be opened. out
+// is written from the PTY-copy goroutine and read back by auditSnapshot
+// from a separate goroutine when the shell exits; a plain bytes.Buffer
+// has no locking of its own and those two would otherwise race.
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Read(p)
+}
+
+// auditSnapshot copies whatever out currently has buffered into a fresh,
+// concrete *bytes.Buffer for events.NewShell, which expects that concrete
+// type rather than the io.ReadWriter interface out is held as (out may be
+// a *rollingCapture, whose Read is documented to serve exactly this kind
+// of caller). A read error is logged and isolated: the audit event is
+// still built, just with whatever was copied before it failed.
+func auditSnapshot(ctx *ctx, out io.ReadWriter) *bytes.Buffer {
+	var snapshot bytes.Buffer
+	if _, err := io.Copy(&snapshot, out); err != nil {
+		log.Errorf("%v failed to snapshot output for audit event: %v", ctx, err)
+	}
+	return &snapshot
+}
+
 func (s *session) broadcastResult(r execResult) {
 	for _, p := range s.parties {
 		p.ctx.sendResult(r)
@@ -201,26 +590,131 @@ func (s *session) leave(id string) error {
 	log.Infof("%v is leaving %v", p, s)
 	delete(s.parties, p.id)
 	s.writer.deleteWriter(p.id)
+	s.emit(SessionEvent{Type: EventPartyLeave, Party: p.id})
 	return nil
 }
 
 func (s *session) addParty(p *party) {
 	s.parties[p.id] = p
 	s.writer.addWriter(p.id, p)
+	s.emit(SessionEvent{Type: EventPartyJoin, Party: p.id})
 	p.ctx.addCloser(p)
+	// Observers and moderators watch the session but must never drive
+	// it: only peers get their input forwarded to the shell.
+	if p.mode != ModePeer {
+		return
+	}
 	go func() {
-		written, err := io.Copy(s.t.pty, p.ch)
+		written, err := io.Copy(gatedWriter{w: s.t.pty, g: s.inputGate}, p.ch)
 		log.Infof("%v channel to shell copy closed, bytes written: %v, err: %v",
 			p.ctx, written, err)
 	}()
 }
 
-func (s *session) join(sconn *ssh.ServerConn, ch ssh.Channel, req *ssh.Request, ctx *ctx) (*party, error) {
-	p := newParty(s, sconn, ch, ctx)
+func (s *session) join(sconn *ssh.ServerConn, ch ssh.Channel, req *ssh.Request, ctx *ctx, mode PartyMode) (*party, error) {
+	p := newParty(s, sconn, ch, ctx, mode)
 	s.addParty(p)
 	return p, nil
 }
 
+// requestJoin holds p as pending moderator review instead of attaching it
+// to the session immediately. approve or deny resolves it. A closer is
+// registered so a connection that drops while still awaiting approval is
+// removed from pending instead of leaking for the life of the session.
+func (s *session) requestJoin(p *party) {
+	s.pending[p.id] = p
+	p.ctx.addCloser(closerFunc(func() error {
+		return s.r.removePending(s, p.id)
+	}))
+	s.broadcast(fmt.Sprintf("%v is waiting for approval to join", p))
+}
+
+// approve attaches a pending party, completing a join that was held for
+// moderator review.
+func (s *session) approve(id string) error {
+	p, ok := s.pending[id]
+	if !ok {
+		return fmt.Errorf("no pending join: %v", id)
+	}
+	delete(s.pending, id)
+	s.addParty(p)
+	s.broadcast(fmt.Sprintf("%v was approved to join", p))
+	return nil
+}
+
+// deny rejects a pending join, closing its channel without ever
+// attaching it to the session.
+func (s *session) deny(id string) error {
+	p, ok := s.pending[id]
+	if !ok {
+		return fmt.Errorf("no pending join: %v", id)
+	}
+	delete(s.pending, id)
+	if err := p.ch.Close(); err != nil {
+		log.Errorf("%v failed to close channel for denied party %v: %v", s, p, err)
+	}
+	return nil
+}
+
+// kick closes party id's channel, forcibly disconnecting it. The caller
+// (sessionRegistry.kickParty) is responsible for unregistering it from
+// parties and writer via removeParty once the channel is closed.
+func (s *session) kick(id string) error {
+	p, ok := s.parties[id]
+	if !ok {
+		return fmt.Errorf("failed to find party: %v", id)
+	}
+	s.broadcast(fmt.Sprintf("%v was removed by a moderator", p))
+	if err := p.ch.Close(); err != nil {
+		log.Errorf("%v failed to close channel: %v", p, err)
+	}
+	return nil
+}
+
+// pause buffers PTY output and stops forwarding every party's stdin to
+// the shell, without closing any channel, so a moderator can resume the
+// session later.
+func (s *session) pause() {
+	s.inputGate.setPaused(true)
+	s.writer.setPaused(true)
+	s.emit(SessionEvent{Type: EventPause})
+	s.broadcast("session paused by moderator")
+}
+
+// resume releases a paused session: buffered PTY output is flushed and
+// stdin is forwarded again.
+func (s *session) resume() {
+	s.inputGate.setPaused(false)
+	s.writer.setPaused(false)
+	s.emit(SessionEvent{Type: EventResume})
+	s.broadcast("session resumed by moderator")
+}
+
+// broadcast writes an inline banner to every attached party's channel,
+// used to surface moderator actions without going through the shell's
+// own output stream.
+func (s *session) broadcast(msg string) {
+	banner := []byte(fmt.Sprintf("\r\n*** %v ***\r\n", msg))
+	for _, p := range s.parties {
+		if _, err := p.ch.Write(banner); err != nil {
+			log.Errorf("%v failed to write banner to %v: %v", s, p, err)
+		}
+	}
+}
+
+// terminate forcibly ends the session: it closes every attached party's
+// channel, disconnecting it, and then closes the PTY, which in turn
+// causes the shell process to exit. Only a moderator party may call this.
+func (s *session) terminate() error {
+	log.Infof("terminating %v", s)
+	for _, p := range s.parties {
+		if err := p.ch.Close(); err != nil {
+			log.Errorf("%v failed to close channel: %v", p, err)
+		}
+	}
+	return s.Close()
+}
+
 type joinSubsys struct {
 	srv *Server
 	sid string
@@ -252,51 +746,297 @@ func (j *joinSubsys) execute(sconn *ssh.ServerConn, ch ssh.Channel, req *ssh.Req
 	return nil
 }
 
+// sessionControlSubsys is the "moderate:<sid>" SSH subsystem: a control
+// channel a moderator keeps open to issue line-delimited commands
+// ("kick <party>", "pause", "resume", "approve <party>", "deny <party>",
+// "terminate") against a running session.
+type sessionControlSubsys struct {
+	srv *Server
+	sid string
+}
+
+func parseSessionControlSubsys(name string, srv *Server) (*sessionControlSubsys, error) {
+	return &sessionControlSubsys{
+		srv: srv,
+		sid: strings.TrimPrefix(name, "moderate:"),
+	}, nil
+}
+
+func (m *sessionControlSubsys) String() string {
+	return fmt.Sprintf("sessionControlSubsys(sid=%v)", m.sid)
+}
+
+func (m *sessionControlSubsys) execute(sconn *ssh.ServerConn, ch ssh.Channel, req *ssh.Request, ctx *ctx) error {
+	if err := m.srv.reg.requireModerator(m.sid, ctx.login); err != nil {
+		log.Errorf("%v denied moderating session %v: %v", ctx, m.sid, err)
+		return err
+	}
+	scanner := bufio.NewScanner(ch)
+	for scanner.Scan() {
+		if err := m.srv.reg.dispatchControl(m.sid, scanner.Text()); err != nil {
+			log.Errorf("%v moderate command failed: %v", ctx, err)
+			fmt.Fprintf(ch, "error: %v\r\n", err)
+		}
+	}
+	return scanner.Err()
+}
+
 func newMultiWriter() *multiWriter {
-	return &multiWriter{writers: make(map[string]io.Writer)}
+	return &multiWriter{writers: make(map[string]*writerEntry)}
 }
 
+// multiWriter fans a single stream of PTY output out to every registered
+// writer. Each writer gets its own writerEntry, so one slow or broken
+// party can neither short-write the whole call nor block the others.
 type multiWriter struct {
-	sync.RWMutex
-	writers map[string]io.Writer
+	sync.Mutex
+	writers map[string]*writerEntry
+	// paused, buf implement the moderator "pause" command: while paused,
+	// writes accumulate in buf (capped at pauseBufferCapacity, oldest
+	// bytes dropped first) instead of reaching the writers, and are
+	// flushed to them in order once resumed.
+	paused bool
+	buf    bytes.Buffer
 }
 
 func (m *multiWriter) addWriter(id string, w io.Writer) {
 	m.Lock()
 	defer m.Unlock()
-	m.writers[id] = w
+	m.writers[id] = newWriterEntry(id, w)
 }
 
 func (m *multiWriter) deleteWriter(id string) {
 	m.Lock()
 	defer m.Unlock()
-	delete(m.writers, id)
+	if e, ok := m.writers[id]; ok {
+		e.close()
+		delete(m.writers, id)
+	}
+}
+
+// flush blocks until id's writer entry has delivered everything pushed to
+// it so far. It is a no-op if id isn't registered.
+func (m *multiWriter) flush(id string) {
+	m.Lock()
+	e, ok := m.writers[id]
+	m.Unlock()
+	if ok {
+		e.flush()
+	}
+}
+
+// setPaused toggles buffering. Resuming flushes any output accumulated
+// while paused to every registered writer.
+func (m *multiWriter) setPaused(paused bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.paused = paused
+	if paused || m.buf.Len() == 0 {
+		return
+	}
+	buffered := m.buf.Bytes()
+	m.buf.Reset()
+	m.writeLocked(buffered)
 }
 
+// pauseBufferCapacity bounds how many bytes of PTY output accumulate in
+// multiWriter.buf while a session is paused. Writes beyond the cap drop
+// the oldest buffered bytes, so a long pause on a chatty shell can't grow
+// memory without bound.
+const pauseBufferCapacity = 1 << 20 // 1 MiB
+
+// captureFlushTimeout bounds how long session exit waits for the capture
+// writer to drain before snapshotting anyway. Capturing is best-effort
+// elsewhere in this file (a full disk or hung capture log shouldn't stop a
+// session from running), so a stuck writer here must not hang exit/audit
+// reporting for every party forever — it can only cost this much
+// completeness in the snapshot.
+const captureFlushTimeout = 5 * time.Second
+
 func (t *multiWriter) Write(p []byte) (n int, err error) {
-	t.RLock()
-	defer t.RUnlock()
+	t.Lock()
+	defer t.Unlock()
 
-	for _, w := range t.writers {
-		n, err = w.Write(p)
-		if err != nil {
-			return
+	if t.paused {
+		n, err = t.buf.Write(p)
+		if excess := t.buf.Len() - pauseBufferCapacity; excess > 0 {
+			t.buf.Next(excess)
+		}
+		return n, err
+	}
+	return t.writeLocked(p)
+}
+
+// writeLocked hands p to every writer's ring buffer. It never blocks on
+// a slow writer and never fails because one writer errored: those are
+// each writerEntry's problem alone.
+func (t *multiWriter) writeLocked(p []byte) (int, error) {
+	for _, e := range t.writers {
+		e.push(p)
+	}
+	return len(p), nil
+}
+
+// writerRingCapacity bounds how many unflushed chunks a writerEntry will
+// hold for a stalled writer before it starts dropping the oldest ones.
+const writerRingCapacity = 256
+
+// writerEntry pairs a registered writer with a bounded ring buffer and a
+// background goroutine that drains it. push is non-blocking: once the
+// ring is full, the oldest queued chunk is dropped (and counted) to make
+// room, so a stalled party can never back up the PTY producer or any
+// other party's output.
+type writerEntry struct {
+	id   string
+	w    io.Writer
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queue holds chunks not yet delivered to w, oldest first.
+	queue [][]byte
+	// dropped counts bytes discarded since the last chunk drained, so a
+	// "N bytes dropped" marker can be inserted into w's stream before
+	// the next chunk.
+	dropped int
+	closed  bool
+	// pending counts chunks pushed but not yet fully written to w (queued
+	// plus the one currently being delivered, if any), so flush can wait
+	// for actual delivery instead of merely queue becoming empty.
+	pending int
+}
+
+func newWriterEntry(id string, w io.Writer) *writerEntry {
+	e := &writerEntry{id: id, w: w}
+	e.cond = sync.NewCond(&e.mu)
+	go e.drain()
+	return e
+}
+
+func (e *writerEntry) push(p []byte) {
+	cp := make([]byte, len(p))
+	copy(cp, p)
+
+	e.mu.Lock()
+	if len(e.queue) >= writerRingCapacity {
+		e.dropped += len(e.queue[0])
+		e.queue = e.queue[1:]
+		e.pending--
+	}
+	e.queue = append(e.queue, cp)
+	e.pending++
+	e.mu.Unlock()
+	// Broadcast, not Signal: flush also waits on cond, and each waiter
+	// rechecks its own predicate, so waking every waiter is safe and
+	// avoids a push's wakeup landing on a flush call instead of drain.
+	e.cond.Broadcast()
+}
+
+// drain delivers queued chunks to w one at a time until the entry is
+// closed and drained. A write error is logged and isolated to this
+// writer; it never reaches the PTY producer or any other party.
+func (e *writerEntry) drain() {
+	for {
+		e.mu.Lock()
+		for len(e.queue) == 0 && !e.closed {
+			e.cond.Wait()
 		}
-		if n != len(p) {
-			err = io.ErrShortWrite
+		if len(e.queue) == 0 {
+			e.mu.Unlock()
 			return
 		}
+		chunk := e.queue[0]
+		e.queue = e.queue[1:]
+		dropped := e.dropped
+		e.dropped = 0
+		e.mu.Unlock()
+
+		if dropped > 0 {
+			marker := []byte(fmt.Sprintf("\r\n*** %v bytes dropped ***\r\n", dropped))
+			if _, err := e.w.Write(marker); err != nil {
+				log.Errorf("writer %v failed, isolating: %v", e.id, err)
+			}
+		}
+		if _, err := e.w.Write(chunk); err != nil {
+			log.Errorf("writer %v failed, isolating: %v", e.id, err)
+		}
+
+		e.mu.Lock()
+		e.pending--
+		if e.pending == 0 {
+			e.cond.Broadcast()
+		}
+		e.mu.Unlock()
 	}
-	return len(p), nil
 }
 
-func newParty(s *session, sconn *ssh.ServerConn, ch ssh.Channel, ctx *ctx) *party {
+// flush blocks until every chunk pushed so far has been delivered to w
+// (or dropped for overflow), so a caller reading from w afterward is
+// guaranteed to see everything pushed up to this point.
+func (e *writerEntry) flush() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for e.pending > 0 {
+		e.cond.Wait()
+	}
+}
+
+func (e *writerEntry) close() {
+	e.mu.Lock()
+	e.closed = true
+	e.mu.Unlock()
+	e.cond.Broadcast()
+}
+
+// gate blocks writers until resumed, implementing the "stop forwarding
+// stdin" half of a moderator pause.
+type gate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+}
+
+func newGate() *gate {
+	g := &gate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+func (g *gate) wait() {
+	g.mu.Lock()
+	for g.paused {
+		g.cond.Wait()
+	}
+	g.mu.Unlock()
+}
+
+func (g *gate) setPaused(paused bool) {
+	g.mu.Lock()
+	g.paused = paused
+	g.mu.Unlock()
+	if !paused {
+		g.cond.Broadcast()
+	}
+}
+
+// gatedWriter delays every Write until g is resumed, then forwards it to
+// w unchanged.
+type gatedWriter struct {
+	w io.Writer
+	g *gate
+}
+
+func (gw gatedWriter) Write(p []byte) (int, error) {
+	gw.g.wait()
+	return gw.w.Write(p)
+}
+
+func newParty(s *session, sconn *ssh.ServerConn, ch ssh.Channel, ctx *ctx, mode PartyMode) *party {
 	return &party{
 		id:    uuid.New(),
 		sconn: sconn,
 		ch:    ch,
 		ctx:   ctx,
 		s:     s,
+		mode:  mode,
 	}
 }
 
@@ -306,6 +1046,10 @@ type party struct {
 	sconn *ssh.ServerConn
 	ch    ssh.Channel
 	ctx   *ctx
+	// mode is the access level this party joined with, as decided by
+	// SessionAccessChecker. It controls whether the party's input is
+	// forwarded to the shell and whether it may moderate the session.
+	mode PartyMode
 }
 
 func (p *party) Write(bytes []byte) (int, error) {